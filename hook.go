@@ -2,13 +2,22 @@ package hook
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
+	"net/http"
 	"runtime"
+	"strings"
+	"time"
 
 	"cloud.google.com/go/errorreporting"
 	"cloud.google.com/go/logging"
+	logpb "cloud.google.com/go/logging/apiv2/loggingpb"
+	mrpb "google.golang.org/genproto/googleapis/api/monitoredres"
 
+	pkgerrors "github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
@@ -25,30 +34,112 @@ var DefaultLogLevels = []logrus.Level{
 	logrus.InfoLevel,
 }
 
+// SendContext describes the entry that BeforeSend is about to ship to
+// Stackdriver. It is modeled after sentry-go's BeforeSend hint, and exists so
+// BeforeSend implementations have room to grow without changing the callback
+// signature again.
+type SendContext struct {
+	// Hook identifies which Stackdriver service is about to receive the
+	// entry, e.g. "log" or "error_report".
+	Hook string
+}
+
+// BeforeSendFunc inspects or rewrites a logrus.Entry immediately before it is
+// shipped to Stackdriver. Returning nil drops the entry; any other value,
+// including the entry unchanged, is what gets serialized. Use it to redact
+// PII, sample, or reroute entries before they leave the process.
+type BeforeSendFunc func(*logrus.Entry, *SendContext) *logrus.Entry
+
+// DefaultErrorReportSkipFrames is the number of additional stack frames
+// ErrorReport.Fire skips, on top of Fire itself, when it falls back to
+// capturing the caller's stack via runtime.Callers.
+const DefaultErrorReportSkipFrames = 0
+
 // ErrorReport sends log events to stackdriver error report service
 type ErrorReport struct {
-	client *errorreporting.Client
-	levels []logrus.Level
+	client     *errorreporting.Client
+	levels     []logrus.Level
+	beforeSend BeforeSendFunc
+	skipFrames int
+	spool      *spool
+}
+
+// ErrorReportOption configures an ErrorReport constructed by NewErrorReport.
+type ErrorReportOption func(*ErrorReport)
+
+// WithReportLevels overrides DefaultErrorLevels with the given levels.
+func WithReportLevels(levels ...logrus.Level) ErrorReportOption {
+	return func(h *ErrorReport) {
+		h.levels = levels
+	}
+}
+
+// WithReportBeforeSend installs a BeforeSend callback, run on every entry
+// before it is reported to Stackdriver Error Reporting.
+func WithReportBeforeSend(fn BeforeSendFunc) ErrorReportOption {
+	return func(h *ErrorReport) {
+		h.beforeSend = fn
+	}
+}
+
+// WithReportSkipFrames adds skip additional frames, beyond Fire itself, to
+// skip when ErrorReport.Fire captures a caller stack because the entry
+// doesn't already carry one. Use this when Fire is invoked through an extra
+// layer of wrapping, e.g. a custom logrus.Hook that forwards to ErrorReport.
+func WithReportSkipFrames(skip int) ErrorReportOption {
+	return func(h *ErrorReport) {
+		h.skipFrames = skip
+	}
+}
+
+// WithReportSpool spools reports to dir when the Error Reporting API is
+// unreachable, sweeping dir every sweep interval to retry them with
+// exponential backoff, and evicting the oldest files once dir would exceed
+// maxBytes. This turns ErrorReport from best-effort into an at-least-once
+// shipper for edge nodes and short-lived jobs whose network to Google can
+// hiccup. Delivery, including retries, happens off of Fire's goroutine, so
+// configuring a spool never makes Fire block.
+func WithReportSpool(dir string, sweep time.Duration, maxBytes int64) ErrorReportOption {
+	return func(h *ErrorReport) {
+		h.spool = newSpool(dir, sweep, maxBytes, h.retrySpooled)
+	}
 }
 
-// NewErrorReport instantiates a ErrorReport
-func NewErrorReport(client *errorreporting.Client, levels ...logrus.Level) *ErrorReport {
-	if levels == nil {
-		levels = DefaultErrorLevels
+// NewErrorReport instantiates a ErrorReport.
+//
+// BREAKING: prior to BeforeSend/Flush/Close/spool support, this took
+// levels ...logrus.Level positionally. Pass WithReportLevels(levels...)
+// instead; a call like NewErrorReport(client, logrus.ErrorLevel) no longer
+// compiles.
+func NewErrorReport(client *errorreporting.Client, opts ...ErrorReportOption) *ErrorReport {
+	h := &ErrorReport{
+		client:     client,
+		levels:     DefaultErrorLevels,
+		skipFrames: DefaultErrorReportSkipFrames,
 	}
 
-	return &ErrorReport{
-		client: client,
-		levels: levels,
+	for _, opt := range opts {
+		opt(h)
 	}
+
+	return h
 }
 
 // Fire implements logrus.Hook
 func (h *ErrorReport) Fire(e *logrus.Entry) error {
-	var buf [16 * 1024]byte
+	if h.beforeSend != nil {
+		e = h.beforeSend(e, &SendContext{Hook: "error_report"})
+		if e == nil {
+			return nil
+		}
+	}
 
-	n := runtime.Stack(buf[:], false)
-	callerStack := chopstack(buf[:n])
+	var stack []byte
+	if st, ok := stackTraceFromEntry(e); ok {
+		stack = []byte(formatStackTrace(st))
+	} else {
+		stack = captureStack(h.skipFrames + 1) // +1 for Fire itself
+	}
 
 	var user string
 	if val, ok := e.Data["user"]; ok {
@@ -60,89 +151,369 @@ func (h *ErrorReport) Fire(e *logrus.Entry) error {
 		}
 	}
 
-	h.client.Report(errorreporting.Entry{
+	report := errorreporting.Entry{
 		Error: errors.New(e.Message),
-		Stack: callerStack,
+		Stack: stack,
 		// User  string        // an identifier for the user affected by the error
 		User: user,
 		// Req   *http.Request // if error is associated with a request.
-	})
+	}
+
+	if h.spool == nil {
+		h.client.Report(report)
+		return nil
+	}
+
+	// See spool.deliver: Fire stays non-blocking, and bounded, even though a
+	// spool is configured.
+	h.spool.deliver(
+		func(ctx context.Context) error {
+			return h.client.ReportSync(ctx, report)
+		},
+		func() ([]byte, error) {
+			return json.Marshal(spooledReport{Message: e.Message, Stack: stack, User: user})
+		},
+	)
 
 	return nil
 }
 
+// retrySpooled decodes a report spooled by Fire and attempts to deliver it
+// synchronously. It's passed to newSpool as the retry callback.
+func (h *ErrorReport) retrySpooled(data []byte) error {
+	var sr spooledReport
+	if err := json.Unmarshal(data, &sr); err != nil {
+		log.Printf("hook: dropping corrupted spooled report: %v", err)
+		return nil
+	}
+
+	return h.client.ReportSync(context.Background(), errorreporting.Entry{
+		Error: errors.New(sr.Message),
+		Stack: sr.Stack,
+		User:  sr.User,
+	})
+}
+
+// spooledReport is the on-disk representation of a report ErrorReport.Fire
+// couldn't deliver. errorreporting.Entry itself isn't serializable: its
+// Error field is an interface whose concrete type is usually unexported, so
+// we keep only what's needed to reconstruct one for a retry.
+type spooledReport struct {
+	Message string
+	Stack   []byte
+	User    string
+}
+
 // Levels implements logrus.Hook
 func (h *ErrorReport) Levels() []logrus.Level {
 	return h.levels
 }
 
+// Drain forces the spool, if configured, to retry everything it's holding
+// until it succeeds or ctx is done. It's a no-op if WithReportSpool wasn't
+// used.
+func (h *ErrorReport) Drain(ctx context.Context) error {
+	if h.spool == nil {
+		return nil
+	}
+	return h.spool.Drain(ctx)
+}
+
+// Flush blocks until currently buffered error reports are sent, or timeout
+// elapses. It returns whether the flush completed before the deadline.
+func (h *ErrorReport) Flush(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		h.client.Flush()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Close flushes any buffered error reports and closes the underlying
+// errorreporting.Client. The client must not be used after Close returns.
+// Call Drain first if spooled reports must be retried before shutdown.
+func (h *ErrorReport) Close() error {
+	if h.spool != nil {
+		h.spool.Stop()
+	}
+	return h.client.Close()
+}
+
 // Log sends events to stackdriver logging service
 type Log struct {
-	logger *logging.Logger
-	levels []logrus.Level
+	logger     *logging.Logger
+	levels     []logrus.Level
+	beforeSend BeforeSendFunc
+	spool      *spool
+	resource   *mrpb.MonitoredResource
+}
+
+// LogOption configures a Log constructed by NewLog.
+type LogOption func(*Log)
+
+// WithLogLevels overrides DefaultLogLevels with the given levels.
+func WithLogLevels(levels ...logrus.Level) LogOption {
+	return func(h *Log) {
+		h.levels = levels
+	}
 }
 
-// NewLog returns a LogHook
-func NewLog(logger *logging.Logger, levels ...logrus.Level) *Log {
-	if levels == nil {
-		levels = DefaultLogLevels
+// WithLogBeforeSend installs a BeforeSend callback, run on every entry before
+// it is written to Stackdriver Logging.
+func WithLogBeforeSend(fn BeforeSendFunc) LogOption {
+	return func(h *Log) {
+		h.beforeSend = fn
 	}
+}
 
-	return &Log{
+// WithLogSpool spools entries to dir when Stackdriver Logging is
+// unreachable. See WithReportSpool for the at-least-once guarantee this
+// provides and its non-blocking delivery.
+func WithLogSpool(dir string, sweep time.Duration, maxBytes int64) LogOption {
+	return func(h *Log) {
+		h.spool = newSpool(dir, sweep, maxBytes, h.retrySpooled)
+	}
+}
+
+// WithLogResource tags every entry with resource, e.g. a specific GKE or
+// Cloud Run resource, instead of relying on the logging.Logger's client-level
+// default.
+func WithLogResource(resource *mrpb.MonitoredResource) LogOption {
+	return func(h *Log) {
+		h.resource = resource
+	}
+}
+
+// NewLog returns a LogHook.
+//
+// BREAKING: prior to BeforeSend/Flush/Close/spool support, this took
+// levels ...logrus.Level positionally. Pass WithLogLevels(levels...)
+// instead; a call like NewLog(logger, logrus.WarnLevel) no longer compiles.
+func NewLog(logger *logging.Logger, opts ...LogOption) *Log {
+	h := &Log{
 		logger: logger,
-		levels: levels,
+		levels: DefaultLogLevels,
+	}
+
+	for _, opt := range opts {
+		opt(h)
 	}
+
+	return h
 }
 
 // Fire implements logrus.Hook
 func (h *Log) Fire(e *logrus.Entry) error {
-	h.logger.Log(h.toEntry(e))
+	if h.beforeSend != nil {
+		e = h.beforeSend(e, &SendContext{Hook: "log"})
+		if e == nil {
+			return nil
+		}
+	}
+
+	entry := h.toEntry(e)
+
+	if h.spool == nil {
+		h.logger.Log(entry)
+		return nil
+	}
+
+	// See spool.deliver: Fire stays non-blocking, and bounded, even though a
+	// spool is configured.
+	h.spool.deliver(
+		func(ctx context.Context) error {
+			return h.logger.LogSync(ctx, entry)
+		},
+		func() ([]byte, error) {
+			return json.Marshal(entry)
+		},
+	)
 
 	return nil
 }
 
+// retrySpooled decodes an entry spooled by Fire and attempts to deliver it
+// synchronously. It's passed to newSpool as the retry callback.
+func (h *Log) retrySpooled(data []byte) error {
+	var entry logging.Entry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		log.Printf("hook: dropping corrupted spooled entry: %v", err)
+		return nil
+	}
+
+	return h.logger.LogSync(context.Background(), entry)
+}
+
 // Levels implements logrus.Hook
 func (h *Log) Levels() []logrus.Level {
 	return h.levels
 }
 
+// Drain forces the spool, if configured, to retry everything it's holding
+// until it succeeds or ctx is done. It's a no-op if WithLogSpool wasn't used.
+func (h *Log) Drain(ctx context.Context) error {
+	if h.spool == nil {
+		return nil
+	}
+	return h.spool.Drain(ctx)
+}
+
+// Flush blocks until buffered log entries are written, or timeout elapses.
+// It returns whether the flush completed before the deadline.
+func (h *Log) Flush(timeout time.Duration) bool {
+	done := make(chan error, 1)
+	go func() {
+		done <- h.logger.Flush()
+	}()
+
+	select {
+	case err := <-done:
+		return err == nil
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Close flushes any buffered log entries. logging.Logger has no explicit
+// close of its own; the underlying logging.Client, which callers own, should
+// be closed separately once all of its loggers have been flushed. Call Drain
+// first if spooled entries must be retried before shutdown.
+func (h *Log) Close() error {
+	if h.spool != nil {
+		h.spool.Stop()
+	}
+	return h.logger.Flush()
+}
+
+// stackTracer is the interface implemented by github.com/pkg/errors error
+// values that carry a captured stack trace.
+type stackTracer interface {
+	StackTrace() pkgerrors.StackTrace
+}
+
 func (h *Log) toEntry(e *logrus.Entry) logging.Entry {
 
 	labels := make(map[string]string, len(e.Data))
+	fields := make(map[string]interface{}, len(e.Data))
+	structured := false
 
-	// var httpReq *logging.HTTPRequest
+	var httpReq *logging.HTTPRequest
+	var stackTrace string
 
 	for k, v := range e.Data {
+		switch k {
+		case "http_request":
+			if req := httpRequestFromField(v); req != nil {
+				httpReq = req
+				continue
+			}
+		case "stack":
+			if st, ok := v.(stackTracer); ok {
+				stackTrace = formatStackTrace(st.StackTrace())
+				structured = true
+				continue
+			}
+		case severityFieldKey, severityFieldKeyAlt:
+			continue
+		}
+
 		switch v := v.(type) {
 		case string:
 			labels[k] = v
-		// case *http.Request:
-		// 	httpReq = &logging.HTTPRequest{
-		// 		Referer:       v.Referer(),
-		// 		RemoteIp:      v.RemoteAddr,
-		// 		RequestMethod: v.Method,
-		// 		RequestUrl:    v.URL.String(),
-		// 		UserAgent:     v.UserAgent(),
-		// 	}
-
-		// case *logging.HttpRequest:
-		// 	httpReq = x
+			fields[k] = v
 		default:
-			labels[k] = fmt.Sprintf("%v", v)
+			structured = true
+			fields[k] = v
 		}
 	}
 
-	// TODO: support "caller"
-	// TODO: support "stack"
-	// TODO: support severity field to override default mapping from level
+	var payload interface{} = e.Message
+	if structured {
+		jsonPayload := make(map[string]interface{}, len(fields)+2)
+		jsonPayload["message"] = e.Message
+		for k, v := range fields {
+			jsonPayload[k] = v
+		}
+		if stackTrace != "" {
+			jsonPayload["stack_trace"] = stackTrace
+		}
+		payload = jsonPayload
+	}
+
+	entry := logging.Entry{
+		Timestamp:   e.Time,
+		Severity:    h.severity(e),
+		Payload:     payload,
+		Labels:      labels,
+		HTTPRequest: httpReq,
+		Resource:    h.resource,
+	}
+
+	if e.Caller != nil {
+		entry.SourceLocation = &logpb.LogEntrySourceLocation{
+			File:     e.Caller.File,
+			Line:     int64(e.Caller.Line),
+			Function: e.Caller.Function,
+		}
+	}
+
+	return entry
+}
+
+// httpRequestFromField converts the value stored under the "http_request"
+// logrus field into a *logging.HTTPRequest. It accepts a plain *http.Request,
+// or a *logging.HTTPRequest for callers that already want to set response
+// status, size, or latency themselves.
+func httpRequestFromField(v interface{}) *logging.HTTPRequest {
+	switch v := v.(type) {
+	case *http.Request:
+		return &logging.HTTPRequest{Request: v}
+	case *logging.HTTPRequest:
+		return v
+	default:
+		return nil
+	}
+}
+
+// formatStackTrace renders a pkg/errors stack trace in the
+// "goroutine 1 [running]:\n<func>\n\t<file>:<line>" shape that Stackdriver's
+// Error Reporting parser expects, so entries carrying a stack auto-group
+// the same way a reported error would.
+func formatStackTrace(st pkgerrors.StackTrace) string {
+	return fmt.Sprintf("goroutine 1 [running]:%+v", st)
+}
+
+// severityFieldKey and severityFieldKeyAlt are reserved logrus field names
+// that, when set to a string like "NOTICE", "ALERT", or "EMERGENCY",
+// override levelToSeverity's mapping for that entry. This reaches
+// Stackdriver severities logrus doesn't natively distinguish.
+const (
+	severityFieldKey    = "severity"
+	severityFieldKeyAlt = "sd_severity"
+)
 
-	return logging.Entry{
-		Timestamp: e.Time,
-		Severity:  levelToSeverity(e.Level),
-		Payload:   e.Message,
-		Labels:    labels,
+// severity resolves the Stackdriver severity for e: a severity/sd_severity
+// field wins if present and recognized, otherwise it falls back to
+// levelToSeverity.
+func (h *Log) severity(e *logrus.Entry) logging.Severity {
+	for _, key := range [...]string{severityFieldKey, severityFieldKeyAlt} {
+		s, ok := e.Data[key].(string)
+		if !ok {
+			continue
+		}
+		if sev := logging.ParseSeverity(s); sev != logging.Default {
+			return sev
+		}
 	}
 
+	return levelToSeverity(e.Level)
 }
 
 func levelToSeverity(l logrus.Level) logging.Severity {
@@ -160,46 +531,97 @@ func levelToSeverity(l logrus.Level) logging.Severity {
 	}
 }
 
-func chopstack(buf []byte) []byte {
-	// stack trace looks something like the following. We wkip over all log internal lines
-	// line goroutine 1 [running]:
-	// line github.com/hayeah/logrus-stackdriver-hook.(*ErrorReport).Fire(0xc0000bcae0, 0xc0001a8a10, 0x2, 0xc0001d6148)
-	// line    /Users/howard/src/logrus-stackdriver-hook/hook.go:41 +0x6c
-	// line github.com/sirupsen/logrus.LevelHooks.Fire(0xc0000a21b0, 0x2, 0xc0001a8a10, 0x863010d3dc30c, 0xc02278d058)
-	// line    /Users/howard/go/pkg/mod/github.com/sirupsen/logrus@v1.4.0/hooks.go:28 +0x91
-	// line github.com/sirupsen/logrus.(*Entry).fireHooks(0xc0001a8a10)
-	// line    /Users/howard/go/pkg/mod/github.com/sirupsen/logrus@v1.4.0/entry.go:247 +0x8c
-	// line github.com/sirupsen/logrus.Entry.log(0xc0000b8120, 0xc0001c4b40, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, ...)
-	// line    /Users/howard/go/pkg/mod/github.com/sirupsen/logrus@v1.4.0/entry.go:225 +0xf6
-	// line github.com/sirupsen/logrus.(*Entry).Log(0xc0001a89a0, 0xc000000002, 0xc00025bf08, 0x1, 0x1)
-	// line    /Users/howard/go/pkg/mod/github.com/sirupsen/logrus@v1.4.0/entry.go:269 +0xc8
-	// line github.com/sirupsen/logrus.(*Logger).Log(0xc0000b8120, 0x2, 0xc00025bf08, 0x1, 0x1)
-	// line    /Users/howard/go/pkg/mod/github.com/sirupsen/logrus@v1.4.0/logger.go:192 +0x7d
-	// line github.com/sirupsen/logrus.(*Logger).Error(0xc0000b8120, 0xc00025bf08, 0x1, 0x1)
-	// line    /Users/howard/go/pkg/mod/github.com/sirupsen/logrus@v1.4.0/logger.go:224 +0x51
-	// line github.com/sirupsen/logrus.Error(0xc00025bf08, 0x1, 0x1)
-	// line    /Users/howard/go/pkg/mod/github.com/sirupsen/logrus@v1.4.0/exported.go:124 +0x4b
-	// line main.dologs(0x0, 0x0)
-	// line    /Users/howard/src/logrus-stackdriver-hook/example/main.go:33 +0x2d3
-	// line main.main()
-	// line    /Users/howard/src/logrus-stackdriver-hook/example/main.go:39 +0x22
-
-	lines := bytes.Split(buf, []byte{'\n'})
-
-	i := 3
+// internalPackages are skipped by captureStack because they're hook/logrus
+// plumbing rather than the caller's own code. Matched by package path, not
+// string prefix, so a vendored copy (e.g. ".../vendor/github.com/sirupsen/logrus")
+// is still recognized.
+var internalPackages = []string{
+	"github.com/sirupsen/logrus",
+	"github.com/hayeah/logrus-stackdriver-hook",
+}
+
+// stackTraceFromEntry looks for a pkg/errors stack trace attached to any
+// field of e, including down an error field's Unwrap chain, e.g. an error
+// passed via logrus.WithError wrapped with pkgerrors.Wrap.
+func stackTraceFromEntry(e *logrus.Entry) (pkgerrors.StackTrace, bool) {
+	for _, v := range e.Data {
+		if st, ok := stackTraceFromValue(v); ok {
+			return st, true
+		}
+	}
+
+	return nil, false
+}
+
+func stackTraceFromValue(v interface{}) (pkgerrors.StackTrace, bool) {
+	if st, ok := v.(stackTracer); ok {
+		return st.StackTrace(), true
+	}
+
+	err, ok := v.(error)
+	if !ok {
+		return nil, false
+	}
+
+	for err != nil {
+		if st, ok := err.(stackTracer); ok {
+			return st.StackTrace(), true
+		}
+		err = errors.Unwrap(err)
+	}
+
+	return nil, false
+}
+
+// captureStack walks the current goroutine's call stack via runtime.Callers,
+// skipping skip frames beyond captureStack itself plus any frame belonging to
+// an internalPackages package, and renders the remainder in the shape
+// Stackdriver's Error Reporting parser requires.
+//
+// This replaces parsing the text of runtime.Stack: matching frames by PC and
+// package path survives vendoring and function inlining, where matching on
+// the literal "github.com/sirupsen/logrus." string prefix does not.
+func captureStack(skip int) []byte {
+	const maxFrames = 64
+
+	pcs := make([]uintptr, maxFrames)
+	n := runtime.Callers(skip+2, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	var buf bytes.Buffer
+	buf.WriteString("goroutine 1 [running]:")
+
 	for {
-		line := lines[i]
-		if !bytes.HasPrefix(line, []byte("github.com/sirupsen/logrus.")) {
+		frame, more := frames.Next()
+		if !isInternalFrame(frame.Function) {
+			fmt.Fprintf(&buf, "\n%s\n\t%s:%d", frame.Function, frame.File, frame.Line)
+		}
+		if !more {
 			break
 		}
+	}
+
+	return buf.Bytes()
+}
 
-		i += 2
+func isInternalFrame(function string) bool {
+	pkg := packagePath(function)
+	for _, internal := range internalPackages {
+		if pkg == internal || strings.HasSuffix(pkg, "/"+internal) {
+			return true
+		}
 	}
+	return false
+}
 
-	// We can't omit the first line, or else the RPC would reject the error entry
-	// because it can't recognize the stackframe.
-	//
-	// See:
-	// https://github.com/googleapis/google-cloud-go/issues/1084
-	return bytes.Join(append([][]byte{lines[0]}, lines[i:]...), []byte("\n"))
+// packagePath extracts the package import path from a runtime.Frame's
+// Function, e.g. "github.com/sirupsen/logrus.(*Entry).fireHooks" becomes
+// "github.com/sirupsen/logrus".
+func packagePath(function string) string {
+	slash := strings.LastIndex(function, "/")
+	rest := function[slash+1:]
+	if dot := strings.Index(rest, "."); dot >= 0 {
+		return function[:slash+1+dot]
+	}
+	return function
 }
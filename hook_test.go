@@ -0,0 +1,167 @@
+package hook
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/logging"
+	pkgerrors "github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	stackHeaderRe = regexp.MustCompile(`^goroutine \d+ \[running\]:$`)
+	stackFrameRe  = regexp.MustCompile(`^\t\S+:\d+$`)
+)
+
+// assertStackdriverShape checks that stack matches the
+// "goroutine N [running]:\n<func>\n\t<file>:<line>" shape Stackdriver's Error
+// Reporting parser requires: a single-goroutine header followed by
+// alternating function/file:line lines.
+func assertStackdriverShape(t *testing.T, stack string) {
+	t.Helper()
+
+	lines := strings.Split(stack, "\n")
+	if len(lines) == 0 || !stackHeaderRe.MatchString(lines[0]) {
+		t.Fatalf("stack does not start with a goroutine header: %q", lines[0])
+	}
+
+	rest := lines[1:]
+	if len(rest)%2 != 0 {
+		t.Fatalf("expected an even number of function/file:line lines, got %d:\n%s", len(rest), stack)
+	}
+
+	for i := 0; i < len(rest); i += 2 {
+		function, file := rest[i], rest[i+1]
+		if function == "" || strings.HasPrefix(function, "\t") {
+			t.Fatalf("line %d should be a bare function name, got %q", i, function)
+		}
+		if !stackFrameRe.MatchString(file) {
+			t.Fatalf("line %d should be a tab-indented file:line, got %q", i+1, file)
+		}
+	}
+}
+
+func TestFormatStackTrace(t *testing.T) {
+	err := pkgerrors.New("boom")
+
+	st, ok := err.(stackTracer)
+	if !ok {
+		t.Fatal("pkgerrors.New should produce a stackTracer")
+	}
+
+	assertStackdriverShape(t, formatStackTrace(st.StackTrace()))
+}
+
+func TestStackTraceFromEntry_WrappedError(t *testing.T) {
+	cause := pkgerrors.New("root cause")
+	wrapped := pkgerrors.Wrap(cause, "while doing the thing")
+
+	entry := logrus.WithField(logrus.ErrorKey, wrapped)
+
+	st, ok := stackTraceFromEntry(entry)
+	if !ok {
+		t.Fatal("expected a stack trace from a wrapped pkg/errors error")
+	}
+
+	assertStackdriverShape(t, formatStackTrace(st))
+}
+
+func TestStackTraceFromEntry_NoStack(t *testing.T) {
+	entry := logrus.WithField("user", "howard")
+
+	if _, ok := stackTraceFromEntry(entry); ok {
+		t.Fatal("did not expect a stack trace when no field carries one")
+	}
+}
+
+func TestCaptureStack(t *testing.T) {
+	assertStackdriverShape(t, string(captureStack(0)))
+}
+
+func TestLog_SeverityOverride(t *testing.T) {
+	h := &Log{}
+
+	cases := []struct {
+		name  string
+		entry *logrus.Entry
+		want  logging.Severity
+	}{
+		{"no override", logrus.WithField("user", "howard"), logging.Warning},
+		{"severity field", logrus.WithField(severityFieldKey, "NOTICE"), logging.Notice},
+		{"sd_severity field", logrus.WithField(severityFieldKeyAlt, "ALERT"), logging.Alert},
+		{"unrecognized falls back", logrus.WithField(severityFieldKey, "nonsense"), logging.Warning},
+	}
+
+	for _, c := range cases {
+		c.entry.Level = logrus.WarnLevel
+		if got := h.severity(c.entry); got != c.want {
+			t.Errorf("%s: severity() = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestErrorReport_Fire_DropsEntryWhenBeforeSendReturnsNil(t *testing.T) {
+	h := &ErrorReport{
+		beforeSend: func(*logrus.Entry, *SendContext) *logrus.Entry { return nil },
+	}
+
+	entry := logrus.WithField("user", "howard")
+	entry.Level = logrus.ErrorLevel
+
+	if err := h.Fire(entry); err != nil {
+		t.Fatalf("Fire() = %v, want nil", err)
+	}
+}
+
+func TestLog_Fire_DropsEntryWhenBeforeSendReturnsNil(t *testing.T) {
+	h := &Log{
+		beforeSend: func(*logrus.Entry, *SendContext) *logrus.Entry { return nil },
+	}
+
+	entry := logrus.WithField("user", "howard")
+	entry.Level = logrus.WarnLevel
+
+	if err := h.Fire(entry); err != nil {
+		t.Fatalf("Fire() = %v, want nil", err)
+	}
+}
+
+func TestLog_ToEntry_FallsThroughWhenFieldNotConsumed(t *testing.T) {
+	h := &Log{}
+
+	entry := logrus.WithFields(logrus.Fields{
+		"stack":        "some plain string",
+		"http_request": "GET /foo",
+	})
+	entry.Level = logrus.WarnLevel
+
+	got := h.toEntry(entry)
+
+	if got.Labels["stack"] != "some plain string" {
+		t.Errorf("Labels[%q] = %q, want the field to fall through unconsumed", "stack", got.Labels["stack"])
+	}
+	if got.Labels["http_request"] != "GET /foo" {
+		t.Errorf("Labels[%q] = %q, want the field to fall through unconsumed", "http_request", got.Labels["http_request"])
+	}
+	if got.HTTPRequest != nil {
+		t.Errorf("HTTPRequest = %+v, want nil since the field wasn't a *http.Request or *logging.HTTPRequest", got.HTTPRequest)
+	}
+}
+
+func TestIsInternalFrame(t *testing.T) {
+	cases := map[string]bool{
+		"github.com/sirupsen/logrus.(*Entry).fireHooks":                 true,
+		"github.com/hayeah/logrus-stackdriver-hook.(*ErrorReport).Fire": true,
+		"some/app/vendor/github.com/sirupsen/logrus.(*Logger).Log":      true,
+		"main.main": false,
+		"github.com/someuser/github.com/sirupsen/logrus-clone.Foo": false,
+	}
+
+	for function, want := range cases {
+		if got := isInternalFrame(function); got != want {
+			t.Errorf("isInternalFrame(%q) = %v, want %v", function, got, want)
+		}
+	}
+}
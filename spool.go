@@ -0,0 +1,274 @@
+package hook
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// spoolQueueCapacity bounds the in-memory queue a spool holds in front of
+// disk. Once full, Save spills straight to disk instead of blocking Fire.
+const spoolQueueCapacity = 256
+
+// spoolMaxBackoff caps the exponential backoff applied between disk sweeps
+// when the upstream client keeps rejecting retries.
+const spoolMaxBackoff = 5 * time.Minute
+
+// deliverTimeout bounds how long a single deliver call waits for send before
+// giving up and spooling, so a hung network call can't hold its in-flight
+// slot, and the goroutine it runs in, forever.
+const deliverTimeout = 30 * time.Second
+
+// spoolSeq makes spooled file names unique across goroutines without relying
+// on randomness.
+var spoolSeq uint64
+
+// spool persists opaque, already-encoded entries to disk when the upstream
+// Stackdriver client is unavailable, and retries them with backoff until
+// they can be delivered. See WithLogSpool/WithReportSpool for what this
+// buys Log/ErrorReport.
+//
+// spool operates on pre-encoded []byte so it can be shared between Log
+// (logging.Entry) and ErrorReport (errorreporting.Entry) without needing to
+// know about either type.
+type spool struct {
+	dir      string
+	sweep    time.Duration
+	maxBytes int64
+	retry    func([]byte) error
+
+	queue     chan []byte
+	inFlight  chan struct{}
+	sweepNow  chan struct{}
+	sweepDone chan bool
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// newSpool starts a spool rooted at dir. retry is called, possibly many
+// times, with the exact bytes passed to Save, and should attempt a blocking
+// resend to the upstream client.
+func newSpool(dir string, sweep time.Duration, maxBytes int64, retry func([]byte) error) *spool {
+	s := &spool{
+		dir:      dir,
+		sweep:    sweep,
+		maxBytes: maxBytes,
+		retry:    retry,
+
+		queue:     make(chan []byte, spoolQueueCapacity),
+		inFlight:  make(chan struct{}, spoolQueueCapacity),
+		sweepNow:  make(chan struct{}),
+		sweepDone: make(chan bool),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	go s.run()
+
+	return s
+}
+
+// Save enqueues data for retry, spilling straight to disk if the in-memory
+// queue is already full.
+func (s *spool) Save(data []byte) {
+	select {
+	case s.queue <- data:
+	default:
+		s.writeFile(data)
+	}
+}
+
+// deliver runs send in its own goroutine, bounded to at most
+// spoolQueueCapacity concurrent in-flight deliveries, and capped at
+// deliverTimeout. This is how Fire stays non-blocking and bounded even
+// against an upstream that's down: instead of spawning an unbounded
+// goroutine per Fire call, deliver spools directly once spoolQueueCapacity
+// deliveries are already outstanding. encode is only called, and its result
+// only spooled, if send fails or, in that saturated case, is never attempted.
+func (s *spool) deliver(send func(context.Context) error, encode func() ([]byte, error)) {
+	select {
+	case s.inFlight <- struct{}{}:
+		go func() {
+			defer func() { <-s.inFlight }()
+
+			ctx, cancel := context.WithTimeout(context.Background(), deliverTimeout)
+			defer cancel()
+
+			if err := send(ctx); err != nil {
+				if data, encErr := encode(); encErr == nil {
+					s.Save(data)
+				}
+			}
+		}()
+	default:
+		if data, encErr := encode(); encErr == nil {
+			s.Save(data)
+		}
+	}
+}
+
+// Drain forces an immediate sweep of the spool directory and in-memory
+// queue, retrying until both are empty or ctx is done.
+func (s *spool) Drain(ctx context.Context) error {
+	for {
+		select {
+		case s.sweepNow <- struct{}{}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		select {
+		case drained := <-s.sweepDone:
+			if drained && len(s.queue) == 0 {
+				return nil
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Stop shuts down the background sweeper. Pending spooled files are left on
+// disk to be picked up by a future process.
+func (s *spool) Stop() {
+	close(s.stop)
+	<-s.done
+}
+
+func (s *spool) run() {
+	defer close(s.done)
+
+	backoff := s.sweep
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+
+	for {
+		select {
+		case data := <-s.queue:
+			if err := s.retry(data); err != nil {
+				s.writeFile(data)
+			}
+
+		case <-timer.C:
+			if s.sweepDisk() {
+				backoff = s.sweep
+			} else if backoff *= 2; backoff > spoolMaxBackoff {
+				backoff = spoolMaxBackoff
+			}
+			timer.Reset(backoff)
+
+		case <-s.sweepNow:
+			s.sweepDone <- s.sweepDisk()
+
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// sweepDisk retries every spooled file oldest-first, deleting each on
+// success. It returns whether the directory was fully drained, which is how
+// the backoff resets back down to the configured sweep interval.
+func (s *spool) sweepDisk() bool {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return os.IsNotExist(err)
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if !e.IsDir() {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names) // filenames are timestamp-prefixed, so lexical order is oldest-first
+
+	drained := true
+	for _, name := range names {
+		path := filepath.Join(s.dir, name)
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		if err := s.retry(data); err != nil {
+			drained = false
+			continue
+		}
+
+		os.Remove(path)
+	}
+
+	return drained
+}
+
+// writeFile persists data to the spool directory, evicting the oldest files
+// first if doing so would exceed maxBytes.
+func (s *spool) writeFile(data []byte) {
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		log.Printf("hook: could not create spool dir %s: %v", s.dir, err)
+		return
+	}
+
+	s.evict(int64(len(data)))
+
+	name := fmt.Sprintf("%020d-%08x", time.Now().UnixNano(), atomic.AddUint64(&spoolSeq, 1))
+	path := filepath.Join(s.dir, name)
+
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		log.Printf("hook: could not write spool file %s: %v", path, err)
+	}
+}
+
+// evict deletes the oldest spooled files until adding incoming more bytes
+// would not exceed maxBytes, or there is nothing left to delete.
+func (s *spool) evict(incoming int64) {
+	if s.maxBytes <= 0 {
+		return
+	}
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+
+	type file struct {
+		name string
+		size int64
+	}
+
+	var files []file
+	var total int64
+
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, file{e.Name(), info.Size()})
+		total += info.Size()
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+
+	for i := 0; total+incoming > s.maxBytes && i < len(files); i++ {
+		if err := os.Remove(filepath.Join(s.dir, files[i].name)); err == nil {
+			total -= files[i].size
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package hook
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSpool_SaveRetriesOnNextSweep(t *testing.T) {
+	dir := t.TempDir()
+
+	var mu sync.Mutex
+	var delivered [][]byte
+	fail := true
+
+	s := newSpool(dir, 5*time.Millisecond, 0, func(data []byte) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			return errors.New("upstream unavailable")
+		}
+		delivered = append(delivered, data)
+		return nil
+	})
+	defer s.Stop()
+
+	s.Save([]byte("first"))
+
+	// Give the spool a moment to spill the failed retry to disk.
+	time.Sleep(20 * time.Millisecond)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 spooled file, got %d", len(entries))
+	}
+
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+
+	if err := s.Drain(context.Background()); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(delivered) != 1 || string(delivered[0]) != "first" {
+		t.Fatalf("expected [\"first\"] to be delivered, got %v", delivered)
+	}
+
+	entries, err = os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("expected spool dir to be empty after drain, found %d files", len(entries))
+	}
+}
+
+func TestSpool_EvictsOldestWhenOverMaxBytes(t *testing.T) {
+	dir := t.TempDir()
+
+	s := newSpool(dir, time.Hour, 10, func([]byte) error {
+		return errors.New("never succeeds")
+	})
+	defer s.Stop()
+
+	s.writeFile([]byte("0123456789")) // exactly maxBytes
+	time.Sleep(5 * time.Millisecond)
+	s.writeFile([]byte("abcdefghij")) // forces eviction of the first file
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected the oldest file to be evicted, found %d files", len(entries))
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, entries[0].Name()))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if string(data) != "abcdefghij" {
+		t.Fatalf("expected the newest file to survive eviction, got %q", data)
+	}
+}
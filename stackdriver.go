@@ -0,0 +1,163 @@
+package hook
+
+import (
+	"context"
+	"time"
+
+	"cloud.google.com/go/errorreporting"
+	"cloud.google.com/go/logging"
+	mrpb "google.golang.org/genproto/googleapis/api/monitoredres"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Destination selects which Stackdriver service a level's entries are routed
+// to by Stackdriver's routing table.
+type Destination int
+
+const (
+	// DestinationDrop discards entries at this level.
+	DestinationDrop Destination = iota
+	// DestinationLog sends entries to Stackdriver Logging only.
+	DestinationLog
+	// DestinationErrorReport sends entries to Stackdriver Error Reporting only.
+	DestinationErrorReport
+	// DestinationBoth sends entries to both services.
+	DestinationBoth
+)
+
+// DefaultRouting sends Panic/Fatal/Error to both services, Warn/Info to
+// Logging only, and drops Debug/Trace, mirroring DefaultErrorLevels and
+// DefaultLogLevels.
+var DefaultRouting = map[logrus.Level]Destination{
+	logrus.PanicLevel: DestinationBoth,
+	logrus.FatalLevel: DestinationBoth,
+	logrus.ErrorLevel: DestinationBoth,
+	logrus.WarnLevel:  DestinationLog,
+	logrus.InfoLevel:  DestinationLog,
+	logrus.DebugLevel: DestinationDrop,
+	logrus.TraceLevel: DestinationDrop,
+}
+
+// Stackdriver is a single logrus.Hook that fronts both a Log and an
+// ErrorReport, routing each entry to one or both per a per-level routing
+// table. Register it instead of Log and ErrorReport separately when the two
+// hooks' level sets would otherwise overlap or need to diverge from
+// DefaultLogLevels/DefaultErrorLevels.
+type Stackdriver struct {
+	log     *Log
+	report  *ErrorReport
+	routing map[logrus.Level]Destination
+}
+
+// StackdriverOption configures a Stackdriver constructed by NewStackdriver.
+type StackdriverOption func(*Stackdriver)
+
+// WithRouting overrides DefaultRouting with routing. Levels absent from
+// routing are dropped.
+func WithRouting(routing map[logrus.Level]Destination) StackdriverOption {
+	return func(h *Stackdriver) {
+		h.routing = routing
+	}
+}
+
+// WithResource tags every entry sent to Stackdriver Logging with resource.
+// See WithLogResource for details.
+func WithResource(resource *mrpb.MonitoredResource) StackdriverOption {
+	return func(h *Stackdriver) {
+		WithLogResource(resource)(h.log)
+	}
+}
+
+// WithLogOptions applies opts to the underlying Log as you would via NewLog
+// directly, e.g. to install a BeforeSend or a spool.
+func WithLogOptions(opts ...LogOption) StackdriverOption {
+	return func(h *Stackdriver) {
+		for _, opt := range opts {
+			opt(h.log)
+		}
+	}
+}
+
+// WithReportOptions applies opts to the underlying ErrorReport as you would
+// via NewErrorReport directly, e.g. to install a BeforeSend or a spool.
+func WithReportOptions(opts ...ErrorReportOption) StackdriverOption {
+	return func(h *Stackdriver) {
+		for _, opt := range opts {
+			opt(h.report)
+		}
+	}
+}
+
+// NewStackdriver instantiates a Stackdriver hook. Use WithLogOptions/
+// WithReportOptions to configure the underlying Log/ErrorReport as you would
+// via NewLog/NewErrorReport directly, e.g. to install a BeforeSend or a
+// spool.
+func NewStackdriver(logger *logging.Logger, client *errorreporting.Client, opts ...StackdriverOption) *Stackdriver {
+	h := &Stackdriver{
+		log:     NewLog(logger),
+		report:  NewErrorReport(client),
+		routing: DefaultRouting,
+	}
+
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	return h
+}
+
+// Fire implements logrus.Hook
+func (h *Stackdriver) Fire(e *logrus.Entry) error {
+	switch h.routing[e.Level] {
+	case DestinationLog:
+		return h.log.Fire(e)
+	case DestinationErrorReport:
+		return h.report.Fire(e)
+	case DestinationBoth:
+		if err := h.log.Fire(e); err != nil {
+			return err
+		}
+		return h.report.Fire(e)
+	default: // DestinationDrop, or a level missing from the routing table
+		return nil
+	}
+}
+
+// Levels implements logrus.Hook. It covers every level with a non-drop
+// destination in the routing table.
+func (h *Stackdriver) Levels() []logrus.Level {
+	levels := make([]logrus.Level, 0, len(h.routing))
+	for level, dest := range h.routing {
+		if dest != DestinationDrop {
+			levels = append(levels, level)
+		}
+	}
+	return levels
+}
+
+// Flush blocks until both the Logging and Error Reporting clients have
+// flushed, or timeout elapses.
+func (h *Stackdriver) Flush(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	logOK := h.log.Flush(timeout)
+	return h.report.Flush(time.Until(deadline)) && logOK
+}
+
+// Close closes both the underlying Log and ErrorReport.
+func (h *Stackdriver) Close() error {
+	logErr := h.log.Close()
+	if err := h.report.Close(); err != nil {
+		return err
+	}
+	return logErr
+}
+
+// Drain forces both underlying hooks' spools, if configured, to retry
+// everything they're holding until they succeed or ctx is done.
+func (h *Stackdriver) Drain(ctx context.Context) error {
+	if err := h.log.Drain(ctx); err != nil {
+		return err
+	}
+	return h.report.Drain(ctx)
+}
@@ -0,0 +1,63 @@
+package hook
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestStackdriver_LevelsCoversNonDropRouting(t *testing.T) {
+	h := NewStackdriver(nil, nil, WithRouting(map[logrus.Level]Destination{
+		logrus.ErrorLevel: DestinationBoth,
+		logrus.WarnLevel:  DestinationLog,
+		logrus.DebugLevel: DestinationDrop,
+	}))
+
+	levels := h.Levels()
+	sort.Slice(levels, func(i, j int) bool { return levels[i] < levels[j] })
+
+	want := []logrus.Level{logrus.WarnLevel, logrus.ErrorLevel}
+	sort.Slice(want, func(i, j int) bool { return want[i] < want[j] })
+
+	if len(levels) != len(want) {
+		t.Fatalf("Levels() = %v, want %v", levels, want)
+	}
+	for i := range want {
+		if levels[i] != want[i] {
+			t.Fatalf("Levels() = %v, want %v", levels, want)
+		}
+	}
+}
+
+func TestStackdriver_WithLogOptionsInstallsBeforeSend(t *testing.T) {
+	var called bool
+
+	h := NewStackdriver(nil, nil, WithLogOptions(WithLogBeforeSend(func(e *logrus.Entry, sc *SendContext) *logrus.Entry {
+		called = true
+		return nil // drop, so Fire never touches the nil *logging.Logger
+	})))
+
+	entry := logrus.WithField("user", "howard")
+	entry.Level = logrus.WarnLevel
+
+	if err := h.log.Fire(entry); err != nil {
+		t.Fatalf("Fire() = %v, want nil", err)
+	}
+	if !called {
+		t.Fatal("expected the BeforeSend installed via WithLogOptions to run")
+	}
+}
+
+func TestStackdriver_DefaultRoutingMatchesDefaultLevels(t *testing.T) {
+	for _, l := range DefaultErrorLevels {
+		if DefaultRouting[l] != DestinationBoth {
+			t.Errorf("DefaultRouting[%v] = %v, want DestinationBoth", l, DefaultRouting[l])
+		}
+	}
+	for _, l := range DefaultLogLevels {
+		if DefaultRouting[l] != DestinationLog {
+			t.Errorf("DefaultRouting[%v] = %v, want DestinationLog", l, DefaultRouting[l])
+		}
+	}
+}